@@ -0,0 +1,159 @@
+// Package array implements a compacted array: a sparse []T addressed by
+// an int32 index, backed by a bitmap presence index plus a densely
+// packed slice holding only the elements that are actually present.
+//
+// This keeps O(1) random access to an arbitrary index (one popcount
+// within a single bitmap word) while needing a much smaller memory
+// footprint than a plain []T would, which matters when the index space
+// is big and sparsely populated.
+package array
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"reflect"
+)
+
+// ErrIndexLen is returned by New when index and elts do not have the
+// same length.
+var ErrIndexLen = errors.New("index and elts must have the same length")
+
+// ErrIndexNotAscending is returned by New when index is not strictly
+// ascending.
+var ErrIndexNotAscending = errors.New("index must be strictly ascending")
+
+// ErrEltType is returned when elts is not a slice of a fixed-size type
+// encoding/binary can write.
+var ErrEltType = errors.New("elts must be a slice of a fixed-size type")
+
+const bmWordBits = 64
+
+// Array is a compacted array.
+//
+// Bitmaps marks, one bit per index, which indexes are present.
+// Offsets[i] is the number of present elements before bitmap word i,
+// so the position of element idx inside Elts can be found in O(1) by
+// adding Offsets[idx/64] to the popcount of the bits below idx within
+// word idx/64.
+type Array struct {
+	Cnt     int32
+	EltSize int
+	Bitmaps []uint64
+	Offsets []int32
+	Elts    []byte
+
+	eltType reflect.Type
+}
+
+// New builds a compacted Array from parallel index and elts slices.
+// index must be strictly ascending. elts must be a slice of a
+// fixed-size type, e.g. []uint32.
+func New(index []int32, elts interface{}) (*Array, error) {
+
+	eltsVal := reflect.ValueOf(elts)
+	if eltsVal.Kind() != reflect.Slice {
+		return nil, ErrEltType
+	}
+
+	if eltsVal.Len() != len(index) {
+		return nil, ErrIndexLen
+	}
+
+	eltType := eltsVal.Type().Elem()
+	eltSize := binary.Size(reflect.Zero(eltType).Interface())
+	if eltSize <= 0 {
+		return nil, ErrEltType
+	}
+
+	a := &Array{
+		EltSize: eltSize,
+		eltType: eltType,
+	}
+
+	if len(index) == 0 {
+		return a, nil
+	}
+
+	// Validate strict ascending order before trusting index[len(index)-1]
+	// as the max: an interior element can be larger than the trailing
+	// one while still passing a running idx<=prev check against its own
+	// predecessor, which would size Bitmaps too small and index out of
+	// range before the loop below ever reaches the out-of-order element.
+	prev := int32(-1)
+	for _, idx := range index {
+		if idx <= prev {
+			return nil, ErrIndexNotAscending
+		}
+		prev = idx
+	}
+
+	bitmapCnt := int(index[len(index)-1])/bmWordBits + 1
+	a.Bitmaps = make([]uint64, bitmapCnt)
+
+	buf := new(bytes.Buffer)
+	buf.Grow(eltSize * len(index))
+
+	for i, idx := range index {
+		a.Bitmaps[idx/bmWordBits] |= 1 << uint(idx%bmWordBits)
+
+		if err := binary.Write(buf, binary.LittleEndian, eltsVal.Index(i).Interface()); err != nil {
+			return nil, err
+		}
+	}
+
+	a.Offsets = make([]int32, bitmapCnt)
+	var rank int32
+	for i, word := range a.Bitmaps {
+		a.Offsets[i] = rank
+		rank += int32(bits.OnesCount64(word))
+	}
+
+	a.Cnt = int32(len(index))
+	a.Elts = buf.Bytes()
+
+	return a, nil
+}
+
+// NewEmpty creates an empty Array that remembers zeroElt's type, so
+// that a subsequent Unmarshal knows how to decode the bytes it reads
+// back into Elts.
+func NewEmpty(zeroElt interface{}) (*Array, error) {
+	eltSize := binary.Size(zeroElt)
+	if eltSize <= 0 {
+		return nil, ErrEltType
+	}
+
+	return &Array{
+		EltSize: eltSize,
+		eltType: reflect.TypeOf(zeroElt),
+	}, nil
+}
+
+// Get returns the element stored at idx and whether idx is present.
+func (a *Array) Get(idx int32) (interface{}, bool) {
+
+	word := int(idx) / bmWordBits
+	if word < 0 || word >= len(a.Bitmaps) {
+		return nil, false
+	}
+
+	bit := uint(idx) % bmWordBits
+	bm := a.Bitmaps[word]
+	if bm&(1<<bit) == 0 {
+		return nil, false
+	}
+
+	pos := int(a.Offsets[word]) + bits.OnesCount64(bm&((1<<bit)-1))
+
+	start := pos * a.EltSize
+	end := start + a.EltSize
+
+	v := reflect.New(a.eltType)
+	if err := binary.Read(bytes.NewReader(a.Elts[start:end]), binary.LittleEndian, v.Interface()); err != nil {
+		return nil, false
+	}
+
+	return v.Elem().Interface(), true
+}
@@ -0,0 +1,384 @@
+package serialize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/openacid/slim/array"
+	"github.com/openacid/slim/trie"
+)
+
+// containerMagic identifies a Container file so Open can fail fast on
+// anything else.
+var containerMagic = [8]byte{'s', 'l', 'i', 'm', 'T', 'O', 'C', '1'}
+
+const containerVersion uint32 = 1
+
+// Kinds of objects a Container can embed.
+const (
+	KindBytes uint8 = iota
+	KindArray
+	KindTrie
+)
+
+// ErrNotFound is returned by Container.Get when no entry has the
+// given name.
+var ErrNotFound = errors.New("serialize: no such entry in container")
+
+// ErrUnsupportedKind is returned when Put is given a type Container
+// does not know how to embed, or Get is asked to decode an entry into
+// an incompatible out value.
+var ErrUnsupportedKind = errors.New("serialize: unsupported container entry kind")
+
+// superblock is the fixed record at offset 0 of a Container file. It
+// points at the directory, which is rewritten at the tail on every
+// Commit, so a reader always finds it in O(1).
+type superblock struct {
+	Magic     [8]byte
+	Version   uint32
+	DirOffset int64
+	DirSize   int64
+}
+
+func superblockSize() int64 {
+	return int64(binary.Size(superblock{}))
+}
+
+// Entry describes one object embedded in a Container.
+type Entry struct {
+	Name   string
+	Kind   uint8
+	Offset int64
+	Size   int64
+	CSum   [32]byte
+}
+
+// Container is a self-describing file holding any number of named
+// objects (*array.Array, *trie.Node, or raw []byte today) plus a
+// directory of where to find each one, laid out like a btrfs leaf's
+// superblock and item array: a fixed superblock at offset 0 naming
+// the directory's offset, the directory itself at the tail, and the
+// objects in between.
+type Container struct {
+	rw      io.ReadWriteSeeker
+	entries map[string]Entry
+	order   []string
+	next    int64
+}
+
+// NewContainer opens an existing Container in rw, or initializes a
+// fresh one if rw is empty.
+func NewContainer(rw io.ReadWriteSeeker) (*Container, error) {
+	size, err := rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Container{
+		rw:      rw,
+		entries: make(map[string]Entry),
+	}
+
+	if size < superblockSize() {
+		c.next = superblockSize()
+		return c, nil
+	}
+
+	sbBuf := make([]byte, superblockSize())
+	if err := readAt(rw, 0, sbBuf); err != nil {
+		return nil, err
+	}
+
+	var sb superblock
+	if err := binary.Read(bytes.NewReader(sbBuf), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Magic != containerMagic {
+		return nil, errors.New("serialize: not a container file")
+	}
+
+	dirBuf := make([]byte, sb.DirSize)
+	if err := readAt(rw, sb.DirOffset, dirBuf); err != nil {
+		return nil, err
+	}
+
+	if err := c.loadDirectory(dirBuf); err != nil {
+		return nil, err
+	}
+
+	c.next = sb.DirOffset
+
+	return c, nil
+}
+
+func (c *Container) loadDirectory(dirBuf []byte) error {
+	r := bytes.NewReader(dirBuf)
+
+	var cnt uint32
+	if err := binary.Read(r, binary.LittleEndian, &cnt); err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < cnt; i++ {
+		var nameLen uint16
+		if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil {
+			return err
+		}
+
+		nameBuf := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, nameBuf); err != nil {
+			return err
+		}
+
+		var e Entry
+		e.Name = string(nameBuf)
+		if err := binary.Read(r, binary.LittleEndian, &e.Kind); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &e.Offset); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &e.Size); err != nil {
+			return err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &e.CSum); err != nil {
+			return err
+		}
+
+		c.entries[e.Name] = e
+		c.order = append(c.order, e.Name)
+	}
+
+	return nil
+}
+
+// memWriterAt is an in-memory io.WriterAt, used to capture
+// trie.Marshal's output as a single []byte body so a *trie.Node entry
+// is stored the same way every other Container entry kind is: one
+// contiguous blob, appended to the file by Put.
+type memWriterAt struct {
+	buf []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > int64(len(m.buf)) {
+		grown := make([]byte, end)
+		copy(grown, m.buf)
+		m.buf = grown
+	}
+	copy(m.buf[off:], p)
+	return len(p), nil
+}
+
+func encodeEntryObject(obj interface{}) ([]byte, uint8, error) {
+	switch v := obj.(type) {
+	case []byte:
+		return v, KindBytes, nil
+	case *array.Array:
+		body, err := marshalArrayBody(v)
+		return body, KindArray, err
+	case *trie.Node:
+		mw := &memWriterAt{}
+		if _, err := trie.Marshal(mw, v, 0); err != nil {
+			return nil, 0, err
+		}
+		return mw.buf, KindTrie, nil
+	default:
+		return nil, 0, ErrUnsupportedKind
+	}
+}
+
+// Put embeds obj under name, appending it to the file. A later Put
+// under the same name shadows the earlier entry in the directory;
+// the earlier bytes become dead space until the file is rewritten
+// through a fresh Container.
+func (c *Container) Put(name string, obj interface{}) error {
+	body, kind, err := encodeEntryObject(obj)
+	if err != nil {
+		return err
+	}
+
+	csum, err := computeChecksum(DefaultChecksumAlgo, body)
+	if err != nil {
+		return err
+	}
+
+	if err := writeAt(c.rw, c.next, body); err != nil {
+		return err
+	}
+
+	if _, exists := c.entries[name]; !exists {
+		c.order = append(c.order, name)
+	}
+
+	c.entries[name] = Entry{
+		Name:   name,
+		Kind:   kind,
+		Offset: c.next,
+		Size:   int64(len(body)),
+		CSum:   csum,
+	}
+
+	c.next += int64(len(body))
+
+	return nil
+}
+
+// Get decodes the entry named name into out, which must be *[]byte
+// for a KindBytes entry or *array.Array for a KindArray entry. A
+// KindTrie entry must be read through GetTrie instead: opening a
+// DiskTrie takes a zeroElt and maxPages this generic signature has no
+// room for.
+func (c *Container) Get(name string, out interface{}) error {
+	e, ok := c.entries[name]
+	if !ok {
+		return ErrNotFound
+	}
+
+	body := make([]byte, e.Size)
+	if err := readAt(c.rw, e.Offset, body); err != nil {
+		return err
+	}
+
+	sum, err := computeChecksum(DefaultChecksumAlgo, body)
+	if err != nil {
+		return err
+	}
+	if sum != e.CSum {
+		return ErrChecksumMismatch
+	}
+
+	switch e.Kind {
+	case KindBytes:
+		ptr, ok := out.(*[]byte)
+		if !ok {
+			return ErrUnsupportedKind
+		}
+		*ptr = body
+	case KindArray:
+		a, ok := out.(*array.Array)
+		if !ok {
+			return ErrUnsupportedKind
+		}
+		return unmarshalArrayBody(body, a)
+	default:
+		return ErrUnsupportedKind
+	}
+
+	return nil
+}
+
+// GetTrie decodes the KindTrie entry named name and opens it as a
+// DiskTrie over its bytes. zeroElt and maxPages are forwarded to
+// trie.Open exactly as they would be for a standalone Marshaled trie
+// file.
+func (c *Container) GetTrie(name string, zeroElt interface{}, maxPages int) (*trie.DiskTrie, error) {
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if e.Kind != KindTrie {
+		return nil, ErrUnsupportedKind
+	}
+
+	body := make([]byte, e.Size)
+	if err := readAt(c.rw, e.Offset, body); err != nil {
+		return nil, err
+	}
+
+	sum, err := computeChecksum(DefaultChecksumAlgo, body)
+	if err != nil {
+		return nil, err
+	}
+	if sum != e.CSum {
+		return nil, ErrChecksumMismatch
+	}
+
+	return trie.Open(bytes.NewReader(body), int64(len(body)), zeroElt, maxPages)
+}
+
+// List returns every entry currently in the directory, in Put order.
+func (c *Container) List() []Entry {
+	entries := make([]Entry, 0, len(c.order))
+	for _, name := range c.order {
+		entries = append(entries, c.entries[name])
+	}
+	return entries
+}
+
+// Commit rewrites the directory at the tail of the file and points
+// the superblock at it, making every Put since the last Commit
+// durable and discoverable.
+func (c *Container) Commit() error {
+	dirBuf := new(bytes.Buffer)
+
+	if err := binary.Write(dirBuf, binary.LittleEndian, uint32(len(c.order))); err != nil {
+		return err
+	}
+
+	for _, name := range c.order {
+		e := c.entries[name]
+
+		if err := binary.Write(dirBuf, binary.LittleEndian, uint16(len(e.Name))); err != nil {
+			return err
+		}
+		dirBuf.WriteString(e.Name)
+		if err := binary.Write(dirBuf, binary.LittleEndian, e.Kind); err != nil {
+			return err
+		}
+		if err := binary.Write(dirBuf, binary.LittleEndian, e.Offset); err != nil {
+			return err
+		}
+		if err := binary.Write(dirBuf, binary.LittleEndian, e.Size); err != nil {
+			return err
+		}
+		if err := binary.Write(dirBuf, binary.LittleEndian, e.CSum); err != nil {
+			return err
+		}
+	}
+
+	dirOffset := c.next
+	if err := writeAt(c.rw, dirOffset, dirBuf.Bytes()); err != nil {
+		return err
+	}
+
+	sb := superblock{
+		Magic:     containerMagic,
+		Version:   containerVersion,
+		DirOffset: dirOffset,
+		DirSize:   int64(dirBuf.Len()),
+	}
+
+	sbBuf := new(bytes.Buffer)
+	if err := binary.Write(sbBuf, binary.LittleEndian, sb); err != nil {
+		return err
+	}
+	if err := writeAt(c.rw, 0, sbBuf.Bytes()); err != nil {
+		return err
+	}
+
+	// The directory just written occupies [dirOffset, c.next) now, so
+	// the next Put must append after it instead of overwriting it.
+	c.next = dirOffset + int64(dirBuf.Len())
+
+	return nil
+}
+
+func readAt(rw io.ReadWriteSeeker, off int64, buf []byte) error {
+	if _, err := rw.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(rw, buf)
+	return err
+}
+
+func writeAt(rw io.ReadWriteSeeker, off int64, buf []byte) error {
+	if _, err := rw.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := rw.Write(buf)
+	return err
+}
@@ -0,0 +1,154 @@
+package serialize
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/openacid/slim/array"
+	"github.com/openacid/slim/trie"
+)
+
+var testContainerFn = "container.data"
+
+func TestContainerPutGetCommit(t *testing.T) {
+	wOFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	f, err := os.OpenFile(testContainerFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testContainerFn)
+	defer f.Close()
+
+	c, err := NewContainer(f)
+	if err != nil {
+		t.Fatalf("failed to init container: %v", err)
+	}
+
+	index := []int32{10, 20, 30}
+	elts := []uint32{10, 20, 30}
+	a, err := array.New(index, elts)
+	if err != nil {
+		t.Fatalf("failed to init compacted array: %+v", err)
+	}
+
+	keys := [][]byte{[]byte("abc"), []byte("abd"), []byte("xyz")}
+	root, err := trie.New(keys, []int32{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to build trie: %+v", err)
+	}
+	root.Squash()
+
+	if err := c.Put("idx", a); err != nil {
+		t.Fatalf("failed to put array: %v", err)
+	}
+	if err := c.Put("raw", []byte("hello container")); err != nil {
+		t.Fatalf("failed to put bytes: %v", err)
+	}
+	if err := c.Put("trie", root); err != nil {
+		t.Fatalf("failed to put trie: %v", err)
+	}
+
+	if err := c.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	entries := c.List()
+	if len(entries) != 3 {
+		t.Fatalf("wrong entry count: %d", len(entries))
+	}
+	if entries[0].Name != "idx" || entries[1].Name != "raw" || entries[2].Name != "trie" {
+		t.Fatalf("wrong entry order: %+v", entries)
+	}
+
+	// reopen and read back through a fresh Container.
+	f2, err := os.OpenFile(testContainerFn, os.O_RDWR, 0755)
+	if err != nil {
+		t.Fatalf("failed to reopen file: %v", err)
+	}
+	defer f2.Close()
+
+	c2, err := NewContainer(f2)
+	if err != nil {
+		t.Fatalf("failed to reopen container: %v", err)
+	}
+
+	a2, err := array.NewEmpty(uint32(0))
+	if err != nil {
+		t.Fatalf("expected no error but: %+v", err)
+	}
+	if err := c2.Get("idx", a2); err != nil {
+		t.Fatalf("failed to get array: %v", err)
+	}
+	checkCompactedArray(index, a2, a, t)
+
+	var raw []byte
+	if err := c2.Get("raw", &raw); err != nil {
+		t.Fatalf("failed to get bytes: %v", err)
+	}
+	if !bytes.Equal(raw, []byte("hello container")) {
+		t.Fatalf("wrong raw bytes: %s", raw)
+	}
+
+	var missing []byte
+	if err := c2.Get("nope", &missing); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got: %v", err)
+	}
+
+	dt, err := c2.GetTrie("trie", int32(0), 0)
+	if err != nil {
+		t.Fatalf("failed to get trie: %v", err)
+	}
+	for _, key := range keys {
+		wantLt, wantEq, wantGt := root.Search(key)
+		gotLt, gotEq, gotGt, err := dt.Search(key)
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %v", key, err)
+		}
+		if !reflect.DeepEqual(wantLt, gotLt) || !reflect.DeepEqual(wantEq, gotEq) || !reflect.DeepEqual(wantGt, gotGt) {
+			t.Fatalf("Search(%q): want (%v, %v, %v), got (%v, %v, %v)",
+				key, wantLt, wantEq, wantGt, gotLt, gotEq, gotGt)
+		}
+	}
+	if _, err := c2.GetTrie("idx", int32(0), 0); err != ErrUnsupportedKind {
+		t.Fatalf("expected ErrUnsupportedKind getting a non-trie entry as a trie, got %v", err)
+	}
+}
+
+func TestContainerPutOverwritesEntry(t *testing.T) {
+	wOFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	f, err := os.OpenFile(testContainerFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testContainerFn)
+	defer f.Close()
+
+	c, err := NewContainer(f)
+	if err != nil {
+		t.Fatalf("failed to init container: %v", err)
+	}
+
+	if err := c.Put("raw", []byte("v1")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if err := c.Put("raw", []byte("v2-longer")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if err := c.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	if len(c.List()) != 1 {
+		t.Fatalf("expected a single entry after overwrite, got %d", len(c.List()))
+	}
+
+	var raw []byte
+	if err := c.Get("raw", &raw); err != nil {
+		t.Fatalf("failed to get bytes: %v", err)
+	}
+	if string(raw) != "v2-longer" {
+		t.Fatalf("wrong raw bytes: %s", raw)
+	}
+}
@@ -0,0 +1,220 @@
+package serialize
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"reflect"
+	"sync"
+)
+
+// DefaultPageBits and DefaultMaxPages are the page size (as a power of
+// two) and resident-page cap Open uses when given 0 for either.
+const (
+	DefaultPageBits = 16 // 64 KiB pages
+	DefaultMaxPages = 64
+)
+
+const bmWordBits = 64
+
+type lruPage struct {
+	pgI   int64
+	bytes []byte
+}
+
+// LazyArray is a read-only view of a marshaled *array.Array that keeps
+// Bitmaps and Offsets resident but leaves Elts on disk, fetching
+// fixed-size pages through r on demand and caching the most recently
+// used ones. This lets a huge marshaled array be served straight from
+// a mmap'd or remote file without loading it fully into memory.
+type LazyArray struct {
+	r       io.ReaderAt
+	eltsOff int64
+	eltSize int
+	cnt     int32
+	bitmaps []uint64
+	offsets []int32
+	eltType reflect.Type
+
+	pageBits uint
+	pageSize int64
+	maxPages int
+
+	mu    sync.Mutex
+	cache map[int64]*list.Element
+	order *list.List
+}
+
+// Open reads the header, Bitmaps and Offsets of the array marshaled at
+// off in r, and returns a LazyArray that fetches Elts lazily. zeroElt
+// tells Open how to decode an element, exactly as array.NewEmpty does
+// for the eager path. pageBits and maxPages fall back to
+// DefaultPageBits/DefaultMaxPages when 0.
+//
+// Open does not verify the body checksum: reading the whole body to
+// verify it would defeat the point of staying lazy. Callers who need
+// that guarantee should Unmarshal/UnmarshalAt the object in full
+// instead.
+func Open(r io.ReaderAt, off int64, zeroElt interface{}, pageBits uint, maxPages int) (*LazyArray, error) {
+	if pageBits == 0 {
+		pageBits = DefaultPageBits
+	}
+	if maxPages == 0 {
+		maxPages = DefaultMaxPages
+	}
+
+	hBuf := make([]byte, GetMarshalHeaderSize())
+	if _, err := r.ReadAt(hBuf, off); err != nil {
+		return nil, err
+	}
+
+	h, err := UnmarshalHeader(bytes.NewReader(hBuf))
+	if err != nil {
+		return nil, err
+	}
+
+	bodyOff := off + int64(h.HeaderSize)
+
+	prefix := make([]byte, 4*4)
+	if _, err := r.ReadAt(prefix, bodyOff); err != nil {
+		return nil, err
+	}
+
+	pr := bytes.NewReader(prefix)
+	var cnt, eltSize, bitmapsCnt, eltsLen int32
+	for _, f := range []*int32{&cnt, &eltSize, &bitmapsCnt, &eltsLen} {
+		if err := binary.Read(pr, binary.LittleEndian, f); err != nil {
+			return nil, err
+		}
+	}
+
+	bitmapsOff := bodyOff + int64(len(prefix))
+	bitmapsBuf := make([]byte, int64(bitmapsCnt)*8)
+	if _, err := r.ReadAt(bitmapsBuf, bitmapsOff); err != nil {
+		return nil, err
+	}
+	bitmaps := make([]uint64, bitmapsCnt)
+	if err := binary.Read(bytes.NewReader(bitmapsBuf), binary.LittleEndian, bitmaps); err != nil {
+		return nil, err
+	}
+
+	offsetsOff := bitmapsOff + int64(len(bitmapsBuf))
+	offsetsBuf := make([]byte, int64(bitmapsCnt)*4)
+	if _, err := r.ReadAt(offsetsBuf, offsetsOff); err != nil {
+		return nil, err
+	}
+	offsets := make([]int32, bitmapsCnt)
+	if err := binary.Read(bytes.NewReader(offsetsBuf), binary.LittleEndian, offsets); err != nil {
+		return nil, err
+	}
+
+	_ = eltsLen // kept only for symmetry with marshalArrayBody; pages are read on demand.
+
+	la := &LazyArray{
+		r:        r,
+		eltsOff:  offsetsOff + int64(len(offsetsBuf)),
+		eltSize:  int(eltSize),
+		cnt:      cnt,
+		bitmaps:  bitmaps,
+		offsets:  offsets,
+		eltType:  reflect.TypeOf(zeroElt),
+		pageBits: pageBits,
+		pageSize: 1 << pageBits,
+		maxPages: maxPages,
+		cache:    make(map[int64]*list.Element),
+		order:    list.New(),
+	}
+
+	return la, nil
+}
+
+// Get returns the element at idx and whether idx is present, fetching
+// whatever Elts pages it needs through the LRU cache.
+func (la *LazyArray) Get(idx int32) (interface{}, bool) {
+
+	word := int(idx) / bmWordBits
+	if word < 0 || word >= len(la.bitmaps) {
+		return nil, false
+	}
+
+	bit := uint(idx) % bmWordBits
+	bm := la.bitmaps[word]
+	if bm&(1<<bit) == 0 {
+		return nil, false
+	}
+
+	pos := int(la.offsets[word]) + bits.OnesCount64(bm&((1<<bit)-1))
+	eltOff := int64(pos) * int64(la.eltSize)
+
+	dst := make([]byte, la.eltSize)
+	remaining := dst
+	at := eltOff
+
+	for len(remaining) > 0 {
+		pgI := at >> la.pageBits
+		pgO := at - pgI<<la.pageBits
+
+		pg, err := la.page(pgI)
+		if err != nil {
+			return nil, false
+		}
+
+		n := copy(remaining, pg[pgO:])
+		if n == 0 {
+			return nil, false
+		}
+		remaining = remaining[n:]
+		at += int64(n)
+	}
+
+	v := reflect.New(la.eltType)
+	if err := binary.Read(bytes.NewReader(dst), binary.LittleEndian, v.Interface()); err != nil {
+		return nil, false
+	}
+
+	return v.Elem().Interface(), true
+}
+
+// page returns the pgI-th page of the Elts region, fetching it
+// through r and caching it on a miss.
+func (la *LazyArray) page(pgI int64) ([]byte, error) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	if el, ok := la.cache[pgI]; ok {
+		la.order.MoveToFront(el)
+		return el.Value.(*lruPage).bytes, nil
+	}
+
+	buf := make([]byte, la.pageSize)
+	n, err := la.r.ReadAt(buf, la.eltsOff+pgI<<la.pageBits)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	el := la.order.PushFront(&lruPage{pgI: pgI, bytes: buf})
+	la.cache[pgI] = el
+
+	if la.order.Len() > la.maxPages {
+		oldest := la.order.Back()
+		la.order.Remove(oldest)
+		delete(la.cache, oldest.Value.(*lruPage).pgI)
+	}
+
+	return buf, nil
+}
+
+// Close drops the page cache. It does not close the underlying
+// io.ReaderAt, which the caller still owns.
+func (la *LazyArray) Close() error {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+
+	la.cache = make(map[int64]*list.Element)
+	la.order = list.New()
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package serialize
+
+import (
+	"os"
+	"testing"
+
+	"github.com/openacid/slim/array"
+)
+
+func TestOpenLazyArray(t *testing.T) {
+	index := []int32{10, 20, 30, 40, 50, 60, 70, 80}
+	elts := []uint32{10, 20, 30, 40, 50, 60, 70, 80}
+
+	a, err := array.New(index, elts)
+	if err != nil {
+		t.Fatalf("failed to init compacted array: %+v", err)
+	}
+
+	wOFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	writer, err := os.OpenFile(testDataFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testDataFn)
+
+	if _, err := Marshal(writer, a); err != nil {
+		t.Fatalf("failed to store compacted array: %v", err)
+	}
+	writer.Close()
+
+	reader, err := os.OpenFile(testDataFn, os.O_RDONLY, 0755)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer reader.Close()
+
+	// pageBits=2 (4-byte pages) against 4-byte uint32 elements forces
+	// one element per page; maxPages=1 forces eviction on every Get.
+	la, err := Open(reader, 0, uint32(0), 2, 1)
+	if err != nil {
+		t.Fatalf("failed to open lazy array: %v", err)
+	}
+	defer la.Close()
+
+	for _, idx := range index {
+		got, ok := la.Get(idx)
+		if !ok {
+			t.Fatalf("expected idx %d to be present", idx)
+		}
+		if got.(uint32) != uint32(idx) {
+			t.Fatalf("wrong value at idx %d: %v", idx, got)
+		}
+	}
+
+	if _, ok := la.Get(11); ok {
+		t.Fatalf("idx 11 should not be present")
+	}
+}
+
+// tripleByte is a 3-byte fixed-size element. Paired with a power-of-two
+// pageSize, which can never be a multiple of 3, this forces elements to
+// start at unaligned offsets within a page and to straddle a page
+// boundary mid-element, exercising the multi-page copy loop in Get
+// that a 4-byte element against a 4-byte-multiple page size cannot.
+type tripleByte [3]byte
+
+func TestOpenLazyArrayStraddlesPageBoundary(t *testing.T) {
+	index := []int32{1, 2, 3, 4, 5}
+	elts := make([]tripleByte, len(index))
+	for i, idx := range index {
+		elts[i] = tripleByte{byte(idx), byte(idx + 1), byte(idx + 2)}
+	}
+
+	a, err := array.New(index, elts)
+	if err != nil {
+		t.Fatalf("failed to init compacted array: %+v", err)
+	}
+
+	wOFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	writer, err := os.OpenFile(testDataFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testDataFn)
+
+	if _, err := Marshal(writer, a); err != nil {
+		t.Fatalf("failed to store compacted array: %v", err)
+	}
+	writer.Close()
+
+	reader, err := os.OpenFile(testDataFn, os.O_RDONLY, 0755)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer reader.Close()
+
+	// pageBits=1 (2-byte pages) against 3-byte elements: no element can
+	// fit in a single page, so every Get straddles at least one page
+	// boundary mid-element.
+	la, err := Open(reader, 0, tripleByte{}, 1, 1)
+	if err != nil {
+		t.Fatalf("failed to open lazy array: %v", err)
+	}
+	defer la.Close()
+
+	for i, idx := range index {
+		got, ok := la.Get(idx)
+		if !ok {
+			t.Fatalf("expected idx %d to be present", idx)
+		}
+		if got.(tripleByte) != elts[i] {
+			t.Fatalf("wrong value at idx %d: %v, want %v", idx, got, elts[i])
+		}
+	}
+}
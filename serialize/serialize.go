@@ -0,0 +1,319 @@
+// Package serialize persists an *array.Array to a byte stream and
+// reads it back.
+//
+// Every marshaled object is a DataHeader followed by its body. The
+// header records the body size, the format version and a checksum of
+// the body, so a reader can detect truncation or corruption before it
+// ever touches array internals.
+package serialize
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/openacid/slim/array"
+	"github.com/openacid/slim/version"
+)
+
+// Checksum algorithms a DataHeader.ChecksumAlgo may name.
+//
+// ChecksumAlgoNone is reserved for headers written before checksumming
+// existed: Unmarshal/UnmarshalAt treat it as "nothing to verify"
+// instead of failing, so files in the old format keep loading.
+const (
+	ChecksumAlgoNone uint8 = iota
+	ChecksumAlgoCRC32C
+	ChecksumAlgoSHA256
+)
+
+// DefaultChecksumAlgo is the algorithm Marshal/MarshalAt stamp into
+// new headers: CRC32C (Castagnoli) is cheap enough to not show up in
+// profiles while still catching bit flips and truncation.
+const DefaultChecksumAlgo = ChecksumAlgoCRC32C
+
+// ErrChecksumMismatch is returned by Unmarshal/UnmarshalAt when the
+// checksum recorded in the header does not match the body that was
+// read.
+var ErrChecksumMismatch = errors.New("serialize: checksum mismatch, data is corrupted")
+
+// ErrUnknownChecksumAlgo is returned when a header names a checksum
+// algorithm this build does not know how to compute.
+var ErrUnknownChecksumAlgo = errors.New("serialize: unknown checksum algorithm")
+
+// DataHeader precedes every marshaled object.
+type DataHeader struct {
+	DataSize     uint64
+	HeaderSize   uint64
+	Version      [version.MAXLEN]byte
+	ChecksumAlgo uint8
+	CSum         [32]byte
+}
+
+func makeDataHeader(ver string, headerSize, dataSize uint64) DataHeader {
+	h := DataHeader{
+		DataSize:   dataSize,
+		HeaderSize: headerSize,
+	}
+	copy(h.Version[:], ver)
+	return h
+}
+
+func makeDefaultDataHeader(dataSize uint64) DataHeader {
+	return makeDataHeader(version.VERSION, GetMarshalHeaderSize(), dataSize)
+}
+
+// GetMarshalHeaderSize returns the fixed, on-disk size of a DataHeader.
+func GetMarshalHeaderSize() uint64 {
+	return uint64(binary.Size(DataHeader{}))
+}
+
+func marshalHeader(w io.Writer, h DataHeader) error {
+	return binary.Write(w, binary.LittleEndian, h)
+}
+
+// UnmarshalHeader reads a DataHeader from the front of r.
+func UnmarshalHeader(r io.Reader) (DataHeader, error) {
+	var h DataHeader
+	err := binary.Read(r, binary.LittleEndian, &h)
+	return h, err
+}
+
+// bytesToString returns the NUL-terminated string starting at offset
+// in buf, or "" if buf is too short. The result does not alias buf.
+func bytesToString(buf []byte, offset int) string {
+	if len(buf) <= offset {
+		return ""
+	}
+
+	b := buf[offset:]
+	n := bytes.IndexByte(b, 0)
+	if n < 0 {
+		n = len(b)
+	}
+
+	return string(b[:n])
+}
+
+func computeChecksum(algo uint8, body []byte) ([32]byte, error) {
+	var sum [32]byte
+
+	switch algo {
+	case ChecksumAlgoCRC32C:
+		c := crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli))
+		binary.LittleEndian.PutUint32(sum[:4], c)
+	case ChecksumAlgoSHA256:
+		sum = sha256.Sum256(body)
+	default:
+		return sum, ErrUnknownChecksumAlgo
+	}
+
+	return sum, nil
+}
+
+// marshalArrayBody packs a's fields, self-describing enough that
+// unmarshalArrayBody can rebuild them without any other input.
+func marshalArrayBody(a *array.Array) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.Grow(4*4 + len(a.Bitmaps)*8 + len(a.Offsets)*4 + len(a.Elts))
+
+	fields := []interface{}{
+		a.Cnt,
+		int32(a.EltSize),
+		int32(len(a.Bitmaps)),
+		int32(len(a.Elts)),
+	}
+	for _, f := range fields {
+		if err := binary.Write(buf, binary.LittleEndian, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := binary.Write(buf, binary.LittleEndian, a.Bitmaps); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, a.Offsets); err != nil {
+		return nil, err
+	}
+
+	buf.Write(a.Elts)
+
+	return buf.Bytes(), nil
+}
+
+func unmarshalArrayBody(body []byte, a *array.Array) error {
+	r := bytes.NewReader(body)
+
+	var cnt, eltSize, bitmapsCnt, eltsLen int32
+	for _, f := range []*int32{&cnt, &eltSize, &bitmapsCnt, &eltsLen} {
+		if err := binary.Read(r, binary.LittleEndian, f); err != nil {
+			return err
+		}
+	}
+
+	a.Cnt = cnt
+	a.EltSize = int(eltSize)
+
+	a.Bitmaps = make([]uint64, bitmapsCnt)
+	if err := binary.Read(r, binary.LittleEndian, a.Bitmaps); err != nil {
+		return err
+	}
+
+	a.Offsets = make([]int32, bitmapsCnt)
+	if err := binary.Read(r, binary.LittleEndian, a.Offsets); err != nil {
+		return err
+	}
+
+	a.Elts = make([]byte, eltsLen)
+	if _, err := io.ReadFull(r, a.Elts); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetMarshalSize returns the exact number of bytes Marshal/MarshalAt
+// write for a.
+func GetMarshalSize(a *array.Array) int64 {
+	bodySize := int64(4*4) + int64(len(a.Bitmaps))*8 + int64(len(a.Offsets))*4 + int64(len(a.Elts))
+	return int64(GetMarshalHeaderSize()) + bodySize
+}
+
+func headerFor(body []byte) (DataHeader, error) {
+	h := makeDefaultDataHeader(uint64(len(body)))
+	h.ChecksumAlgo = DefaultChecksumAlgo
+
+	csum, err := computeChecksum(h.ChecksumAlgo, body)
+	if err != nil {
+		return h, err
+	}
+	h.CSum = csum
+
+	return h, nil
+}
+
+func verifyBody(h DataHeader, body []byte) error {
+	// A zero ChecksumAlgo means the object predates checksumming:
+	// skip verification instead of rejecting a file we have no way
+	// to validate.
+	if h.ChecksumAlgo == ChecksumAlgoNone {
+		return nil
+	}
+
+	sum, err := computeChecksum(h.ChecksumAlgo, body)
+	if err != nil {
+		return err
+	}
+
+	if sum != h.CSum {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// Marshal writes a to w as a DataHeader followed by its body, and
+// returns the total number of bytes written.
+func Marshal(w io.Writer, a *array.Array) (int64, error) {
+	body, err := marshalArrayBody(a)
+	if err != nil {
+		return 0, err
+	}
+
+	h, err := headerFor(body)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := marshalHeader(w, h); err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(body)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(h.HeaderSize) + int64(n), nil
+}
+
+// Unmarshal reads a DataHeader and body from r into a, verifying the
+// checksum when the header carries one.
+func Unmarshal(r io.Reader, a *array.Array) error {
+	h, err := UnmarshalHeader(r)
+	if err != nil {
+		return err
+	}
+
+	body := make([]byte, h.DataSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	if err := verifyBody(h, body); err != nil {
+		return err
+	}
+
+	return unmarshalArrayBody(body, a)
+}
+
+// MarshalAt writes a to w at offset, returning the total number of
+// bytes written.
+func MarshalAt(w io.WriterAt, offset int64, a *array.Array) (int64, error) {
+	body, err := marshalArrayBody(a)
+	if err != nil {
+		return 0, err
+	}
+
+	h, err := headerFor(body)
+	if err != nil {
+		return 0, err
+	}
+
+	hBuf := new(bytes.Buffer)
+	if err := marshalHeader(hBuf, h); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.WriteAt(hBuf.Bytes(), offset); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.WriteAt(body, offset+int64(h.HeaderSize)); err != nil {
+		return 0, err
+	}
+
+	return int64(h.HeaderSize) + int64(len(body)), nil
+}
+
+// UnmarshalAt reads a from r at offset into a, returning the total
+// number of bytes read.
+func UnmarshalAt(r io.ReaderAt, offset int64, a *array.Array) (int64, error) {
+	hBuf := make([]byte, GetMarshalHeaderSize())
+	if _, err := r.ReadAt(hBuf, offset); err != nil {
+		return 0, err
+	}
+
+	h, err := UnmarshalHeader(bytes.NewReader(hBuf))
+	if err != nil {
+		return 0, err
+	}
+
+	body := make([]byte, h.DataSize)
+	if _, err := r.ReadAt(body, offset+int64(h.HeaderSize)); err != nil {
+		return 0, err
+	}
+
+	if err := verifyBody(h, body); err != nil {
+		return 0, err
+	}
+
+	if err := unmarshalArrayBody(body, a); err != nil {
+		return 0, err
+	}
+
+	return int64(h.HeaderSize) + int64(h.DataSize), nil
+}
@@ -87,8 +87,8 @@ func TestMakeDataHeader(t *testing.T) {
 		t.Fatalf("wrong data size")
 	}
 
-	// sizeof(uint64) * 2 + version.MAXLEN
-	if header.HeaderSize != 32 {
+	// sizeof(uint64)*2 + version.MAXLEN + sizeof(ChecksumAlgo) + sizeof(CSum)
+	if header.HeaderSize != 65 {
 		t.Fatalf("wrong header size: %v", header.HeaderSize)
 	}
 
@@ -114,8 +114,8 @@ func TestMarshalUnMarshalHeader(t *testing.T) {
 	sHeader := makeDefaultDataHeader(1000)
 
 	gHeaderSize := GetMarshalHeaderSize()
-	if gHeaderSize != 32 {
-		t.Fatalf("wrong header size: 32, %d", gHeaderSize)
+	if gHeaderSize != 65 {
+		t.Fatalf("wrong header size: 65, %d", gHeaderSize)
 	}
 
 	err = marshalHeader(writer, sHeader)
@@ -280,6 +280,94 @@ func TestUnMarshalFromIncompleteReader(t *testing.T) {
 	checkCompactedArray(index, a2, a1, t)
 }
 
+func TestUnmarshalDetectsCorruption(t *testing.T) {
+	index := []int32{10, 20, 30, 40, 50, 60}
+	elts := []uint32{10, 20, 30, 40, 50, 60}
+
+	a, err := array.New(index, elts)
+	if err != nil {
+		t.Fatalf("failed to init compacted array: %+v", err)
+	}
+
+	wOFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	writer, err := os.OpenFile(testDataFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testDataFn)
+
+	cnt, err := Marshal(writer, a)
+	if err != nil {
+		t.Fatalf("failed to store compacted array: %v", err)
+	}
+	writer.Close()
+
+	// flip a byte in the middle of the file to simulate corruption. For
+	// this array that byte lies in the header's CSum field, which then
+	// no longer matches the checksum recomputed over the body.
+	raw, err := os.ReadFile(testDataFn)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	mid := int(cnt) / 2
+	raw[mid] ^= 0xff
+	if err := os.WriteFile(testDataFn, raw, 0755); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	reader, err := os.OpenFile(testDataFn, os.O_RDONLY, 0755)
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	defer reader.Close()
+
+	a2, err := array.NewEmpty(uint32(0))
+	if err != nil {
+		t.Fatalf("expected no error but: %+v", err)
+	}
+
+	err = Unmarshal(reader, a2)
+	if err != ErrChecksumMismatch {
+		t.Fatalf("expected ErrChecksumMismatch, got: %v", err)
+	}
+}
+
+func TestUnmarshalSkipsVerificationForLegacyHeader(t *testing.T) {
+	index := []int32{10, 20, 30}
+	elts := []uint32{10, 20, 30}
+
+	a, err := array.New(index, elts)
+	if err != nil {
+		t.Fatalf("failed to init compacted array: %+v", err)
+	}
+
+	body, err := marshalArrayBody(a)
+	if err != nil {
+		t.Fatalf("failed to marshal body: %v", err)
+	}
+
+	// a header with ChecksumAlgo == 0 mimics a file written before
+	// checksumming existed: it must still load.
+	h := makeDefaultDataHeader(uint64(len(body)))
+
+	buf := new(bytes.Buffer)
+	if err := marshalHeader(buf, h); err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+	buf.Write(body)
+
+	a2, err := array.NewEmpty(uint32(0))
+	if err != nil {
+		t.Fatalf("expected no error but: %+v", err)
+	}
+
+	if err := Unmarshal(buf, a2); err != nil {
+		t.Fatalf("legacy header without checksum should still load: %v", err)
+	}
+
+	checkCompactedArray(index, a2, a, t)
+}
+
 func TestMarshalAtUnMarshalAt(t *testing.T) {
 	index1 := []int32{10, 20, 30, 40, 50, 60}
 	elts1 := []uint32{10, 20, 30, 40, 50, 60}
@@ -0,0 +1,394 @@
+package serialize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"reflect"
+
+	"github.com/openacid/slim/array"
+)
+
+// ErrEltSizeMismatch is returned by Writer.Append when the encoded
+// size of elt does not match the element type the Writer was created
+// with.
+var ErrEltSizeMismatch = errors.New("serialize: element size does not match writer's element type")
+
+// Writer builds a marshaled array from elements delivered one at a
+// time in ascending index order, instead of requiring a fully built
+// *array.Array up front. This is what lets an index be built from a
+// sorted external input bigger than RAM: when out is an io.WriterAt,
+// Writer only ever holds the handful of elements that share a bitmap
+// word (at most 64) before flushing them, plus one small running
+// checksum.
+//
+// The body format is a [Cnt int32][EltSize int32] prefix followed by a
+// sequence of word chunks, [WordIdx int64][Word uint64][elt]*popcount(Word),
+// which lets Reader yield (idx, value)
+// pairs in the same single forward pass that produced them; it is not
+// the same layout Marshal/Unmarshal use, which needs random access to
+// Bitmaps/Offsets instead.
+//
+// If out also implements io.WriterAt, Writer streams every chunk to
+// it as soon as it closes and patches the header's size/count/
+// checksum fields in place at Finish. Otherwise it has no way to go
+// back and fix up the header, so it buffers the whole body in memory
+// and writes it, header first, only once Finish is called.
+type Writer struct {
+	out     io.Writer
+	wa      io.WriterAt
+	eltSize int
+
+	cntFieldOffset int64
+	pos            int64
+
+	started    bool
+	lastIdx    int32
+	openWord   bool
+	curWordIdx int64
+	curWord    uint64
+	curElts    *bytes.Buffer
+	cnt        int32
+
+	crcTable *crc32.Table
+	csum     uint32 // running CRC32C over every flushed chunk's bytes
+
+	body *bytes.Buffer // non-nil only when out is not an io.WriterAt
+}
+
+// NewWriter returns a Writer that encodes elements of zeroElt's type
+// (the same convention array.NewEmpty uses) to out.
+func NewWriter(out io.Writer, zeroElt interface{}) (*Writer, error) {
+	eltSize := binary.Size(zeroElt)
+	if eltSize <= 0 {
+		return nil, array.ErrEltType
+	}
+
+	w := &Writer{
+		out:      out,
+		eltSize:  eltSize,
+		curElts:  new(bytes.Buffer),
+		crcTable: crc32.MakeTable(crc32.Castagnoli),
+	}
+
+	headerSize := int64(GetMarshalHeaderSize())
+
+	if wa, ok := out.(io.WriterAt); ok {
+		w.wa = wa
+
+		if _, err := wa.WriteAt(make([]byte, headerSize), 0); err != nil {
+			return nil, err
+		}
+
+		prefix := new(bytes.Buffer)
+		if err := binary.Write(prefix, binary.LittleEndian, int32(0)); err != nil { // cnt placeholder
+			return nil, err
+		}
+		if err := binary.Write(prefix, binary.LittleEndian, int32(eltSize)); err != nil {
+			return nil, err
+		}
+
+		w.cntFieldOffset = headerSize
+		if _, err := wa.WriteAt(prefix.Bytes(), headerSize); err != nil {
+			return nil, err
+		}
+
+		w.pos = headerSize + int64(prefix.Len())
+	} else {
+		w.body = new(bytes.Buffer)
+	}
+
+	return w, nil
+}
+
+// Append adds the element at idx. idx must be strictly greater than
+// every idx given to a previous Append call.
+func (w *Writer) Append(idx int32, elt interface{}) error {
+	if w.started && idx <= w.lastIdx {
+		return array.ErrIndexNotAscending
+	}
+
+	eltBuf := new(bytes.Buffer)
+	if err := binary.Write(eltBuf, binary.LittleEndian, elt); err != nil {
+		return err
+	}
+	if eltBuf.Len() != w.eltSize {
+		return ErrEltSizeMismatch
+	}
+
+	word := int64(idx) / bmWordBits
+
+	if !w.started {
+		w.curWordIdx = word
+	} else if word != w.curWordIdx {
+		if err := w.flushWord(); err != nil {
+			return err
+		}
+		w.curWordIdx = word
+	}
+
+	w.curWord |= 1 << uint(int64(idx)%bmWordBits)
+	w.curElts.Write(eltBuf.Bytes())
+	w.openWord = true
+
+	w.started = true
+	w.lastIdx = idx
+	w.cnt++
+
+	return nil
+}
+
+// flushWord writes the currently open bitmap word and the elements
+// that belong to it, then resets the in-progress chunk.
+func (w *Writer) flushWord() error {
+	chunk := new(bytes.Buffer)
+	if err := binary.Write(chunk, binary.LittleEndian, w.curWordIdx); err != nil {
+		return err
+	}
+	if err := binary.Write(chunk, binary.LittleEndian, w.curWord); err != nil {
+		return err
+	}
+	chunk.Write(w.curElts.Bytes())
+
+	w.csum = crc32.Update(w.csum, w.crcTable, chunk.Bytes())
+
+	if w.wa != nil {
+		if _, err := w.wa.WriteAt(chunk.Bytes(), w.pos); err != nil {
+			return err
+		}
+		w.pos += int64(chunk.Len())
+	} else {
+		w.body.Write(chunk.Bytes())
+	}
+
+	w.curWord = 0
+	w.curElts.Reset()
+	w.openWord = false
+
+	return nil
+}
+
+// finalChecksum folds the cnt/eltSize prefix into the running chunk
+// checksum, so the stamped CSum covers the whole body, not just the
+// chunks. cnt is only known once every Append has happened, long
+// after the earliest chunks were already hashed, so the prefix is
+// folded in last rather than first: Reader does the same in the same
+// order, so it is still a checksum of the whole body, just not one
+// that hashes the file in byte order.
+func (w *Writer) finalChecksum() ([32]byte, error) {
+	var sum [32]byte
+
+	prefix := new(bytes.Buffer)
+	if err := binary.Write(prefix, binary.LittleEndian, w.cnt); err != nil {
+		return sum, err
+	}
+	if err := binary.Write(prefix, binary.LittleEndian, int32(w.eltSize)); err != nil {
+		return sum, err
+	}
+
+	final := crc32.Update(w.csum, w.crcTable, prefix.Bytes())
+	binary.LittleEndian.PutUint32(sum[:4], final)
+
+	return sum, nil
+}
+
+// Finish flushes any pending chunk and writes the final header,
+// returning once every byte Append produced is durable in out.
+func (w *Writer) Finish() error {
+	if w.openWord {
+		if err := w.flushWord(); err != nil {
+			return err
+		}
+	}
+
+	csum, err := w.finalChecksum()
+	if err != nil {
+		return err
+	}
+
+	var dataSize uint64
+	if w.wa != nil {
+		dataSize = uint64(w.pos - w.cntFieldOffset)
+	} else {
+		dataSize = uint64(8 + w.body.Len())
+	}
+
+	h := makeDefaultDataHeader(dataSize)
+	h.ChecksumAlgo = ChecksumAlgoCRC32C
+	h.CSum = csum
+
+	if w.wa != nil {
+		hBuf := new(bytes.Buffer)
+		if err := marshalHeader(hBuf, h); err != nil {
+			return err
+		}
+		if _, err := w.wa.WriteAt(hBuf.Bytes(), 0); err != nil {
+			return err
+		}
+
+		cntBuf := new(bytes.Buffer)
+		if err := binary.Write(cntBuf, binary.LittleEndian, w.cnt); err != nil {
+			return err
+		}
+		if _, err := w.wa.WriteAt(cntBuf.Bytes(), w.cntFieldOffset); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	full := new(bytes.Buffer)
+	if err := marshalHeader(full, h); err != nil {
+		return err
+	}
+	if err := binary.Write(full, binary.LittleEndian, w.cnt); err != nil {
+		return err
+	}
+	if err := binary.Write(full, binary.LittleEndian, int32(w.eltSize)); err != nil {
+		return err
+	}
+	full.Write(w.body.Bytes())
+
+	_, err = w.out.Write(full.Bytes())
+	return err
+}
+
+// Reader yields the (idx, value) pairs a Writer produced, one word
+// chunk at a time, without ever materializing the whole array. It
+// recomputes the body checksum as it reads, the same one Writer
+// stamped into the header, and checks it once the last element has
+// been yielded: a streaming format can only ever confirm its checksum
+// once every byte has passed through, the same way gzip's trailer
+// does.
+type Reader struct {
+	r       io.Reader
+	eltType reflect.Type
+	eltSize int
+
+	cnt     int32
+	yielded int32
+
+	wordIdx int64
+	pending uint64
+
+	checksumAlgo uint8
+	headerCSum   [32]byte
+	crcTable     *crc32.Table
+	prefixBuf    []byte // raw cnt/eltSize bytes, folded into csum last
+	csum         uint32 // running CRC32C over every chunk byte read so far
+	verified     bool
+}
+
+// NewReader returns a Reader over a stream a Writer produced.
+// zeroElt tells it how to decode an element, as array.NewEmpty does
+// for the eager path.
+func NewReader(r io.Reader, zeroElt interface{}) (*Reader, error) {
+	h, err := UnmarshalHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixBuf := make([]byte, 8)
+	if _, err := io.ReadFull(r, prefixBuf); err != nil {
+		return nil, err
+	}
+
+	pr := bytes.NewReader(prefixBuf)
+	var cnt, eltSize int32
+	if err := binary.Read(pr, binary.LittleEndian, &cnt); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(pr, binary.LittleEndian, &eltSize); err != nil {
+		return nil, err
+	}
+
+	return &Reader{
+		r:            r,
+		eltType:      reflect.TypeOf(zeroElt),
+		eltSize:      int(eltSize),
+		cnt:          cnt,
+		checksumAlgo: h.ChecksumAlgo,
+		headerCSum:   h.CSum,
+		crcTable:     crc32.MakeTable(crc32.Castagnoli),
+		prefixBuf:    prefixBuf,
+	}, nil
+}
+
+// Next returns the next (idx, value) pair, or ok == false once every
+// element the Writer appended has been yielded and the body checksum
+// has been found to match.
+func (rd *Reader) Next() (idx int32, value interface{}, ok bool, err error) {
+	if rd.yielded >= rd.cnt {
+		if !rd.verified {
+			rd.verified = true
+			if verr := rd.verifyChecksum(); verr != nil {
+				return 0, nil, false, verr
+			}
+		}
+		return 0, nil, false, nil
+	}
+
+	if rd.pending == 0 {
+		wordBuf := make([]byte, 16)
+		if _, err = io.ReadFull(rd.r, wordBuf); err != nil {
+			return 0, nil, false, err
+		}
+
+		wr := bytes.NewReader(wordBuf)
+		if err = binary.Read(wr, binary.LittleEndian, &rd.wordIdx); err != nil {
+			return 0, nil, false, err
+		}
+		if err = binary.Read(wr, binary.LittleEndian, &rd.pending); err != nil {
+			return 0, nil, false, err
+		}
+
+		rd.csum = crc32.Update(rd.csum, rd.crcTable, wordBuf)
+	}
+
+	b := bits.TrailingZeros64(rd.pending)
+	rd.pending &^= 1 << uint(b)
+
+	idx = int32(rd.wordIdx*bmWordBits + int64(b))
+
+	eltBuf := make([]byte, rd.eltSize)
+	if _, err = io.ReadFull(rd.r, eltBuf); err != nil {
+		return 0, nil, false, err
+	}
+
+	rd.csum = crc32.Update(rd.csum, rd.crcTable, eltBuf)
+
+	v := reflect.New(rd.eltType)
+	if err = binary.Read(bytes.NewReader(eltBuf), binary.LittleEndian, v.Interface()); err != nil {
+		return 0, nil, false, err
+	}
+
+	rd.yielded++
+
+	return idx, v.Elem().Interface(), true, nil
+}
+
+// verifyChecksum folds the prefix bytes into the running chunk
+// checksum last, the same order Writer.finalChecksum built the
+// stamped value in, and compares the result against it.
+func (rd *Reader) verifyChecksum() error {
+	if rd.checksumAlgo == ChecksumAlgoNone {
+		return nil
+	}
+	if rd.checksumAlgo != ChecksumAlgoCRC32C {
+		return ErrUnknownChecksumAlgo
+	}
+
+	final := crc32.Update(rd.csum, rd.crcTable, rd.prefixBuf)
+
+	var got [32]byte
+	binary.LittleEndian.PutUint32(got[:4], final)
+
+	if got != rd.headerCSum {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
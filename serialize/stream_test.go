@@ -0,0 +1,229 @@
+package serialize
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestWriterReaderOverFile(t *testing.T) {
+	index := []int32{10, 20, 30, 40, 130, 131, 200}
+	elts := []uint32{10, 20, 30, 40, 130, 131, 200}
+
+	wOFlags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	f, err := os.OpenFile(testDataFn, wOFlags, 0755)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer os.Remove(testDataFn)
+	defer f.Close()
+
+	w, err := NewWriter(f, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init writer: %v", err)
+	}
+
+	for i, idx := range index {
+		if err := w.Append(idx, elts[i]); err != nil {
+			t.Fatalf("failed to append idx %d: %v", idx, err)
+		}
+	}
+
+	if err := w.Finish(); err != nil {
+		t.Fatalf("failed to finish: %v", err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("failed to rewind file: %v", err)
+	}
+
+	r, err := NewReader(f, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init reader: %v", err)
+	}
+
+	gotIdx := make([]int32, 0, len(index))
+	gotElts := make([]uint32, 0, len(index))
+	for {
+		idx, v, ok, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		gotIdx = append(gotIdx, idx)
+		gotElts = append(gotElts, v.(uint32))
+	}
+
+	if len(gotIdx) != len(index) {
+		t.Fatalf("wrong element count: %d, want %d", len(gotIdx), len(index))
+	}
+	for i := range index {
+		if gotIdx[i] != index[i] || gotElts[i] != elts[i] {
+			t.Fatalf("element %d: got (%d, %d), want (%d, %d)",
+				i, gotIdx[i], gotElts[i], index[i], elts[i])
+		}
+	}
+}
+
+func TestWriterOverPlainWriter(t *testing.T) {
+	index := []int32{1, 2, 64, 65, 1000}
+	elts := []uint32{1, 2, 64, 65, 1000}
+
+	buf := new(bytes.Buffer)
+
+	w, err := NewWriter(buf, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init writer: %v", err)
+	}
+
+	for i, idx := range index {
+		if err := w.Append(idx, elts[i]); err != nil {
+			t.Fatalf("failed to append idx %d: %v", idx, err)
+		}
+	}
+
+	if err := w.Finish(); err != nil {
+		t.Fatalf("failed to finish: %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init reader: %v", err)
+	}
+
+	gotIdx := make([]int32, 0, len(index))
+	for {
+		idx, v, ok, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		gotIdx = append(gotIdx, idx)
+		if v.(uint32) != uint32(idx) {
+			t.Fatalf("wrong value at idx %d: %v", idx, v)
+		}
+	}
+
+	if len(gotIdx) != len(index) {
+		t.Fatalf("wrong element count: %d, want %d", len(gotIdx), len(index))
+	}
+}
+
+func TestReaderDetectsCorruption(t *testing.T) {
+	index := []int32{10, 20, 30, 40, 50, 60}
+	elts := []uint32{10, 20, 30, 40, 50, 60}
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init writer: %v", err)
+	}
+	for i, idx := range index {
+		if err := w.Append(idx, elts[i]); err != nil {
+			t.Fatalf("failed to append idx %d: %v", idx, err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("failed to finish: %v", err)
+	}
+
+	// flip the first byte of the last element in the chunk body to
+	// simulate corruption.
+	raw := buf.Bytes()
+	mid := len(raw) - 4
+	raw[mid] ^= 0xff
+
+	r, err := NewReader(bytes.NewReader(raw), uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init reader: %v", err)
+	}
+
+	var gotErr error
+	for gotErr == nil {
+		_, _, ok, err := r.Next()
+		if err != nil {
+			gotErr = err
+			break
+		}
+		if !ok {
+			break
+		}
+	}
+
+	if gotErr != ErrChecksumMismatch {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", gotErr)
+	}
+}
+
+func TestReaderDetectsCorruptionInPrefix(t *testing.T) {
+	index := []int32{10, 20, 30}
+	elts := []uint32{10, 20, 30}
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init writer: %v", err)
+	}
+	for i, idx := range index {
+		if err := w.Append(idx, elts[i]); err != nil {
+			t.Fatalf("failed to append idx %d: %v", idx, err)
+		}
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatalf("failed to finish: %v", err)
+	}
+
+	// flip a byte inside the cnt/eltSize prefix, which comes right
+	// after the header and is included in DataSize but, before this
+	// fix, contributed nothing to the stamped checksum. Corrupting a
+	// control field like this can also surface as a decode error
+	// instead of ErrChecksumMismatch (e.g. a garbled cnt stops the
+	// read short); either way it must not be reported as success.
+	raw := buf.Bytes()
+	raw[GetMarshalHeaderSize()] ^= 0xff
+
+	r, err := NewReader(bytes.NewReader(raw), uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init reader: %v", err)
+	}
+
+	n := 0
+	var gotErr error
+	for gotErr == nil {
+		_, _, ok, err := r.Next()
+		if err != nil {
+			gotErr = err
+			break
+		}
+		if !ok {
+			break
+		}
+		n++
+	}
+
+	if gotErr == nil {
+		t.Fatalf("expected an error reading a stream with a corrupted cnt/eltSize prefix, got %d elements with none", n)
+	}
+}
+
+func TestAppendRejectsOutOfOrderIndex(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	w, err := NewWriter(buf, uint32(0))
+	if err != nil {
+		t.Fatalf("failed to init writer: %v", err)
+	}
+
+	if err := w.Append(10, uint32(10)); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+
+	if err := w.Append(5, uint32(5)); err == nil {
+		t.Fatalf("expected an error appending an out-of-order index")
+	}
+}
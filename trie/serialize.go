@@ -0,0 +1,583 @@
+package trie
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// ErrNotContainerFile is returned by Open when the last footerSize()
+// bytes of r do not hold a valid trie footer.
+var ErrNotContainerFile = errors.New("trie: not a marshaled trie")
+
+var diskMagic = [8]byte{'s', 'l', 'i', 'm', 'T', 'R', 'I', 'E'}
+
+const diskVersion uint32 = 1
+
+// MemoryPointer locates a page within a marshaled trie: Offset is
+// where the page starts and Length is its encoded size.
+type MemoryPointer struct {
+	Offset uint64
+	Length uint32
+}
+
+func (p MemoryPointer) isNil() bool {
+	return p.Length == 0
+}
+
+// trieFooter trails every marshaled trie, naming the root page so a
+// reader can locate the whole structure in O(1) regardless of how it
+// was packed.
+type trieFooter struct {
+	Magic   [8]byte
+	Version uint32
+	Root    MemoryPointer
+}
+
+func footerSize() int64 {
+	return int64(binary.Size(trieFooter{}))
+}
+
+// DefaultPageSize is the page budget Marshal uses when given 0.
+const DefaultPageSize = 4096
+
+// Marshal lays the squashed trie rooted at root out as node pages
+// packed greedily into shared, page-budget-sized writes (the same
+// page-budget idea serialize.LazyArray uses for array Elts), linked by
+// MemoryPointer, writing children before their parent so every pointer
+// is known by the time it is needed. It returns the total number of
+// bytes written (the footer naming the root sits in the last
+// footerSize() of those bytes).
+//
+// pageSize bounds how many bytes of sibling node records Marshal
+// buffers before issuing a single WriteAt for the page; it falls back
+// to DefaultPageSize when 0. A node record that alone exceeds pageSize
+// still gets its own (oversized) page rather than being split, since
+// MemoryPointer addresses a contiguous byte range and nodes are never
+// split across pages.
+//
+// root should already have gone through Squash (and RemoveEndLeaves,
+// if applicable): Marshal persists exactly the tree it is given. Every
+// leaf's Value must be a fixed-size type encoding/binary can write
+// (the same constraint array.New places on its elts), and all leaves
+// must share that type: Open needs a single zeroElt to decode them.
+func Marshal(w io.WriterAt, root *Node, pageSize int) (int64, error) {
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+
+	b := &builder{w: w, pageSize: pageSize}
+
+	rootPtr, err := b.writeNode(root)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := b.flushPage(); err != nil {
+		return 0, err
+	}
+
+	footer := trieFooter{
+		Magic:   diskMagic,
+		Version: diskVersion,
+		Root:    rootPtr,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, footer); err != nil {
+		return 0, err
+	}
+
+	if _, err := w.WriteAt(buf.Bytes(), int64(b.next)); err != nil {
+		return 0, err
+	}
+
+	return int64(b.next) + int64(buf.Len()), nil
+}
+
+// builder packs sibling subtrees into shared pages of roughly
+// pageSize bytes, flushing a page as a single WriteAt once the next
+// record would overflow it, instead of issuing one WriteAt per node.
+type builder struct {
+	w        io.WriterAt
+	pageSize int
+	next     uint64
+
+	// pageStart is the absolute file offset the buffered, not yet
+	// flushed bytes in pageBuf begin at.
+	pageStart uint64
+	pageBuf   []byte
+
+	// prevLeafNextFieldOffset is the absolute file offset of the
+	// NextLeaf field inside the previously written leaf page, so it
+	// can be patched once the following leaf's offset is known.
+	prevLeafNextFieldOffset uint64
+	havePrevLeaf            bool
+}
+
+// writeNode writes node's subtree post-order (children first) and
+// returns a pointer to node's own page. Leaves are written in
+// ascending-key order as a side effect of recursing through Branches
+// in their stored (sorted) order, which lets each leaf's NextLeaf
+// pointer be patched in once its successor is written.
+func (b *builder) writeNode(n *Node) (MemoryPointer, error) {
+
+	if len(n.Branches) == 0 {
+		return b.writeLeaf(n)
+	}
+
+	children := make([]MemoryPointer, len(n.Branches))
+	for i, br := range n.Branches {
+		ptr, err := b.writeNode(n.Children[br])
+		if err != nil {
+			return MemoryPointer{}, err
+		}
+		children[i] = ptr
+	}
+
+	return b.writeBranch(n.Branches, n.Step, children)
+}
+
+func (b *builder) writeBranch(branches []int, step uint16, children []MemoryPointer) (MemoryPointer, error) {
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(0) // isLeaf
+
+	if err := binary.Write(buf, binary.LittleEndian, step); err != nil {
+		return MemoryPointer{}, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, uint16(len(branches))); err != nil {
+		return MemoryPointer{}, err
+	}
+
+	int16Branches := make([]int16, len(branches))
+	for i, br := range branches {
+		int16Branches[i] = int16(br)
+	}
+	if err := binary.Write(buf, binary.LittleEndian, int16Branches); err != nil {
+		return MemoryPointer{}, err
+	}
+	if err := binary.Write(buf, binary.LittleEndian, children); err != nil {
+		return MemoryPointer{}, err
+	}
+
+	return b.write(buf.Bytes())
+}
+
+func (b *builder) writeLeaf(n *Node) (MemoryPointer, error) {
+
+	valBuf := new(bytes.Buffer)
+	if err := binary.Write(valBuf, binary.LittleEndian, n.Value); err != nil {
+		return MemoryPointer{}, err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(1) // isLeaf
+	if err := binary.Write(buf, binary.LittleEndian, uint32(valBuf.Len())); err != nil {
+		return MemoryPointer{}, err
+	}
+	buf.Write(valBuf.Bytes())
+
+	nextLeafFieldOffset := b.next + uint64(buf.Len())
+	// next-leaf pointer is unknown until a later leaf is written;
+	// leave it zeroed here and patch it below once that happens.
+	if err := binary.Write(buf, binary.LittleEndian, MemoryPointer{}); err != nil {
+		return MemoryPointer{}, err
+	}
+
+	ptr, err := b.write(buf.Bytes())
+	if err != nil {
+		return MemoryPointer{}, err
+	}
+
+	if b.havePrevLeaf {
+		patch := new(bytes.Buffer)
+		if err := binary.Write(patch, binary.LittleEndian, ptr); err != nil {
+			return MemoryPointer{}, err
+		}
+		if err := b.patch(b.prevLeafNextFieldOffset, patch.Bytes()); err != nil {
+			return MemoryPointer{}, err
+		}
+	}
+
+	b.prevLeafNextFieldOffset = nextLeafFieldOffset
+	b.havePrevLeaf = true
+
+	return ptr, nil
+}
+
+// write appends buf to the current page, flushing that page first if
+// buf would overflow it, and returns a pointer to buf's own (still
+// possibly buffered) position.
+func (b *builder) write(buf []byte) (MemoryPointer, error) {
+	if len(b.pageBuf) > 0 && len(b.pageBuf)+len(buf) > b.pageSize {
+		if err := b.flushPage(); err != nil {
+			return MemoryPointer{}, err
+		}
+	}
+
+	offset := b.next
+	b.pageBuf = append(b.pageBuf, buf...)
+	b.next += uint64(len(buf))
+
+	return MemoryPointer{Offset: offset, Length: uint32(len(buf))}, nil
+}
+
+// flushPage writes every byte buffered for the current page as a
+// single WriteAt and starts a fresh page at the current position.
+func (b *builder) flushPage() error {
+	if len(b.pageBuf) == 0 {
+		return nil
+	}
+
+	if _, err := b.w.WriteAt(b.pageBuf, int64(b.pageStart)); err != nil {
+		return err
+	}
+
+	b.pageStart = b.next
+	b.pageBuf = b.pageBuf[:0]
+
+	return nil
+}
+
+// patch overwrites the len(data) bytes at absolute offset off, which
+// must name a record write has already returned a MemoryPointer for.
+// off may fall inside the still-buffered current page, in which case
+// the edit is applied in memory instead of re-touching bytes already
+// handed to w.
+func (b *builder) patch(off uint64, data []byte) error {
+	if off >= b.pageStart && off+uint64(len(data)) <= b.pageStart+uint64(len(b.pageBuf)) {
+		copy(b.pageBuf[off-b.pageStart:], data)
+		return nil
+	}
+
+	_, err := b.w.WriteAt(data, int64(off))
+	return err
+}
+
+// diskPage is a decoded branch or leaf page.
+type diskPage struct {
+	isLeaf   bool
+	step     uint16
+	branches []int
+	children []MemoryPointer
+	value    interface{}
+	nextLeaf MemoryPointer
+}
+
+// DiskTrie is a read-only view of a trie Marshaled to r: it keeps
+// nothing but a small LRU of recently used pages in memory, following
+// MemoryPointer links to answer Search the same way the in-memory
+// Node does.
+type DiskTrie struct {
+	r         io.ReaderAt
+	root      MemoryPointer
+	valueType reflect.Type
+
+	mu       sync.Mutex
+	cache    map[uint64]*list.Element
+	order    *list.List
+	maxPages int
+}
+
+// DefaultMaxPages is the page-cache size Open uses when given 0.
+const DefaultMaxPages = 256
+
+// Open reads the footer of a trie Marshaled into r (size bytes long)
+// and returns a DiskTrie ready to Search it. zeroElt tells Open how to
+// decode a leaf Value, exactly as array.NewEmpty does for the eager
+// array path.
+func Open(r io.ReaderAt, size int64, zeroElt interface{}, maxPages int) (*DiskTrie, error) {
+	if maxPages == 0 {
+		maxPages = DefaultMaxPages
+	}
+
+	fBuf := make([]byte, footerSize())
+	if _, err := r.ReadAt(fBuf, size-footerSize()); err != nil {
+		return nil, err
+	}
+
+	var footer trieFooter
+	if err := binary.Read(bytes.NewReader(fBuf), binary.LittleEndian, &footer); err != nil {
+		return nil, err
+	}
+	if footer.Magic != diskMagic {
+		return nil, ErrNotContainerFile
+	}
+
+	return &DiskTrie{
+		r:         r,
+		root:      footer.Root,
+		valueType: reflect.TypeOf(zeroElt),
+		cache:     make(map[uint64]*list.Element),
+		order:     list.New(),
+		maxPages:  maxPages,
+	}, nil
+}
+
+type cachedPage struct {
+	offset uint64
+	page   diskPage
+}
+
+func (dt *DiskTrie) readPage(ptr MemoryPointer) (diskPage, error) {
+	dt.mu.Lock()
+	if el, ok := dt.cache[ptr.Offset]; ok {
+		dt.order.MoveToFront(el)
+		p := el.Value.(*cachedPage).page
+		dt.mu.Unlock()
+		return p, nil
+	}
+	dt.mu.Unlock()
+
+	buf := make([]byte, ptr.Length)
+	if _, err := dt.r.ReadAt(buf, int64(ptr.Offset)); err != nil {
+		return diskPage{}, err
+	}
+
+	page, err := dt.decodePage(buf)
+	if err != nil {
+		return diskPage{}, err
+	}
+
+	dt.mu.Lock()
+	el := dt.order.PushFront(&cachedPage{offset: ptr.Offset, page: page})
+	dt.cache[ptr.Offset] = el
+	if dt.order.Len() > dt.maxPages {
+		oldest := dt.order.Back()
+		dt.order.Remove(oldest)
+		delete(dt.cache, oldest.Value.(*cachedPage).offset)
+	}
+	dt.mu.Unlock()
+
+	return page, nil
+}
+
+func (dt *DiskTrie) decodePage(buf []byte) (diskPage, error) {
+	r := bytes.NewReader(buf)
+
+	isLeaf, err := r.ReadByte()
+	if err != nil {
+		return diskPage{}, err
+	}
+
+	if isLeaf == 1 {
+		var valLen uint32
+		if err := binary.Read(r, binary.LittleEndian, &valLen); err != nil {
+			return diskPage{}, err
+		}
+
+		valBuf := make([]byte, valLen)
+		if _, err := io.ReadFull(r, valBuf); err != nil {
+			return diskPage{}, err
+		}
+
+		v := reflect.New(dt.valueType)
+		if err := binary.Read(bytes.NewReader(valBuf), binary.LittleEndian, v.Interface()); err != nil {
+			return diskPage{}, err
+		}
+
+		var nextLeaf MemoryPointer
+		if err := binary.Read(r, binary.LittleEndian, &nextLeaf); err != nil {
+			return diskPage{}, err
+		}
+
+		return diskPage{isLeaf: true, value: v.Elem().Interface(), nextLeaf: nextLeaf}, nil
+	}
+
+	var step uint16
+	if err := binary.Read(r, binary.LittleEndian, &step); err != nil {
+		return diskPage{}, err
+	}
+
+	var cnt uint16
+	if err := binary.Read(r, binary.LittleEndian, &cnt); err != nil {
+		return diskPage{}, err
+	}
+
+	int16Branches := make([]int16, cnt)
+	if err := binary.Read(r, binary.LittleEndian, int16Branches); err != nil {
+		return diskPage{}, err
+	}
+	branches := make([]int, cnt)
+	for i, br := range int16Branches {
+		branches[i] = int(br)
+	}
+
+	children := make([]MemoryPointer, cnt)
+	if err := binary.Read(r, binary.LittleEndian, children); err != nil {
+		return diskPage{}, err
+	}
+
+	return diskPage{isLeaf: false, step: step, branches: branches, children: children}, nil
+}
+
+func (dt *DiskTrie) childOf(p diskPage, br int) (MemoryPointer, bool) {
+	for i, b := range p.branches {
+		if b == br {
+			return p.children[i], true
+		}
+	}
+	return MemoryPointer{}, false
+}
+
+// Search mirrors (*Node).Search, walking pages instead of in-memory
+// children maps.
+func (dt *DiskTrie) Search(key []byte) (ltValue, eqValue, gtValue interface{}, err error) {
+
+	eqPtr := dt.root
+	var ltPtr, gtPtr MemoryPointer
+	haveLt, haveGt := false, false
+
+	for i := 0; ; {
+
+		eqPage, pErr := dt.readPage(eqPtr)
+		if pErr != nil {
+			err = pErr
+			return
+		}
+
+		var br int
+		if len(key) == i {
+			br = leafBranch
+		} else {
+			br = int(key[i])
+		}
+
+		li, ri := neighborBranches(eqPage.branches, br)
+		if li >= 0 {
+			ltPtr = eqPage.children[li]
+			haveLt = true
+		}
+		if ri >= 0 {
+			gtPtr = eqPage.children[ri]
+			haveGt = true
+		}
+
+		childPtr, ok := dt.childOf(eqPage, br)
+		if !ok {
+			break
+		}
+		eqPtr = childPtr
+
+		if br == leafBranch {
+			leaf, lErr := dt.readPage(eqPtr)
+			if lErr != nil {
+				err = lErr
+				return
+			}
+			eqValue = leaf.value
+			eqPtr = MemoryPointer{}
+			break
+		}
+
+		childPage, cErr := dt.readPage(eqPtr)
+		if cErr != nil {
+			err = cErr
+			return
+		}
+		i += int(childPage.step)
+
+		if i > len(key) {
+			gtPtr = eqPtr
+			haveGt = true
+			eqPtr = MemoryPointer{}
+			break
+		}
+	}
+
+	if haveLt {
+		v, lErr := dt.rightMostValue(ltPtr)
+		if lErr != nil {
+			err = lErr
+			return
+		}
+		ltValue = v
+	}
+	if haveGt {
+		v, gErr := dt.leftMostValue(gtPtr)
+		if gErr != nil {
+			err = gErr
+			return
+		}
+		gtValue = v
+	}
+
+	return
+}
+
+func (dt *DiskTrie) leftMostValue(ptr MemoryPointer) (interface{}, error) {
+	for {
+		page, err := dt.readPage(ptr)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.branches) == 0 {
+			return page.value, nil
+		}
+		ptr = page.children[0]
+	}
+}
+
+func (dt *DiskTrie) rightMostValue(ptr MemoryPointer) (interface{}, error) {
+	for {
+		page, err := dt.readPage(ptr)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.branches) == 0 {
+			return page.value, nil
+		}
+		ptr = page.children[len(page.children)-1]
+	}
+}
+
+// LeafCursor walks marshaled leaves in ascending-key order via their
+// NextLeaf pointers, so a range scan is a sequence of reads instead of
+// repeated descents from the root.
+type LeafCursor struct {
+	dt  *DiskTrie
+	ptr MemoryPointer
+}
+
+// FirstLeaf returns a cursor positioned at the smallest key in dt.
+func (dt *DiskTrie) FirstLeaf() (*LeafCursor, error) {
+	ptr := dt.root
+	for {
+		page, err := dt.readPage(ptr)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.branches) == 0 {
+			return &LeafCursor{dt: dt, ptr: ptr}, nil
+		}
+		ptr = page.children[0]
+	}
+}
+
+// Value returns the current leaf's value.
+func (c *LeafCursor) Value() (interface{}, error) {
+	page, err := c.dt.readPage(c.ptr)
+	if err != nil {
+		return nil, err
+	}
+	return page.value, nil
+}
+
+// Next advances the cursor to the following leaf, returning false
+// once there is none.
+func (c *LeafCursor) Next() (bool, error) {
+	page, err := c.dt.readPage(c.ptr)
+	if err != nil {
+		return false, err
+	}
+	if page.nextLeaf.isNil() {
+		return false, nil
+	}
+	c.ptr = page.nextLeaf
+	return true, nil
+}
@@ -0,0 +1,191 @@
+package trie
+
+import (
+	"reflect"
+	"testing"
+)
+
+type memFile struct {
+	buf    []byte
+	writes int
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.writes++
+
+	end := off + int64(len(p))
+	if end > int64(len(f.buf)) {
+		grown := make([]byte, end)
+		copy(grown, f.buf)
+		f.buf = grown
+	}
+	copy(f.buf[off:], p)
+	return len(p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	n := copy(p, f.buf[off:])
+	return n, nil
+}
+
+func TestMarshalOpenSearch(t *testing.T) {
+	keys := [][]byte{
+		[]byte("abc"),
+		[]byte("abd"),
+		[]byte("abe"),
+		[]byte("xyz"),
+	}
+	values := []int32{1, 2, 3, 4}
+
+	root, err := New(keys, values)
+	if err != nil {
+		t.Fatalf("failed to build trie: %v", err)
+	}
+	root.Squash()
+
+	f := &memFile{}
+	size, err := Marshal(f, root, 0)
+	if err != nil {
+		t.Fatalf("failed to marshal trie: %v", err)
+	}
+
+	dt, err := Open(f, size, int32(0), 0)
+	if err != nil {
+		t.Fatalf("failed to open disk trie: %v", err)
+	}
+
+	cases := [][]byte{
+		[]byte("abc"),
+		[]byte("abd"),
+		[]byte("abe"),
+		[]byte("xyz"),
+		[]byte("abd1"), // between abd and abe
+		[]byte("aaa"),  // before everything
+		[]byte("zzz"),  // after everything
+	}
+
+	for _, key := range cases {
+		wantLt, wantEq, wantGt := root.Search(key)
+
+		gotLt, gotEq, gotGt, err := dt.Search(key)
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %v", key, err)
+		}
+
+		if !reflect.DeepEqual(wantLt, gotLt) {
+			t.Fatalf("Search(%q) lt: want %v, got %v", key, wantLt, gotLt)
+		}
+		if !reflect.DeepEqual(wantEq, gotEq) {
+			t.Fatalf("Search(%q) eq: want %v, got %v", key, wantEq, gotEq)
+		}
+		if !reflect.DeepEqual(wantGt, gotGt) {
+			t.Fatalf("Search(%q) gt: want %v, got %v", key, wantGt, gotGt)
+		}
+	}
+}
+
+func TestMarshalPacksSiblingsIntoSharedPages(t *testing.T) {
+	keys := [][]byte{
+		[]byte("abc"),
+		[]byte("abd"),
+		[]byte("abe"),
+		[]byte("xyz"),
+	}
+	values := []int32{1, 2, 3, 4}
+
+	root, err := New(keys, values)
+	if err != nil {
+		t.Fatalf("failed to build trie: %v", err)
+	}
+	root.Squash()
+
+	// A generous page budget should let every record share one page,
+	// so the footer's WriteAt is the only one beyond it.
+	big := &memFile{}
+	if _, err := Marshal(big, root, 1<<20); err != nil {
+		t.Fatalf("failed to marshal trie: %v", err)
+	}
+	if big.writes != 2 {
+		t.Fatalf("expected a single flushed page plus the footer, got %d WriteAt calls", big.writes)
+	}
+
+	// A one-byte budget forces every record onto its own page, the
+	// worst case the shared-page packing is meant to avoid.
+	tiny := &memFile{}
+	size, err := Marshal(tiny, root, 1)
+	if err != nil {
+		t.Fatalf("failed to marshal trie with a tiny page budget: %v", err)
+	}
+	if tiny.writes <= big.writes {
+		t.Fatalf("expected more WriteAt calls with a 1-byte page budget, got %d", tiny.writes)
+	}
+
+	dt, err := Open(tiny, size, int32(0), 0)
+	if err != nil {
+		t.Fatalf("failed to open disk trie: %v", err)
+	}
+	for _, key := range keys {
+		wantLt, wantEq, wantGt := root.Search(key)
+		gotLt, gotEq, gotGt, err := dt.Search(key)
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %v", key, err)
+		}
+		if !reflect.DeepEqual(wantLt, gotLt) || !reflect.DeepEqual(wantEq, gotEq) || !reflect.DeepEqual(wantGt, gotGt) {
+			t.Fatalf("Search(%q): want (%v, %v, %v), got (%v, %v, %v)",
+				key, wantLt, wantEq, wantGt, gotLt, gotEq, gotGt)
+		}
+	}
+}
+
+func TestLeafCursorWalksInOrder(t *testing.T) {
+	keys := [][]byte{
+		[]byte("a"),
+		[]byte("b"),
+		[]byte("c"),
+	}
+	values := []int32{10, 20, 30}
+
+	root, err := New(keys, values)
+	if err != nil {
+		t.Fatalf("failed to build trie: %v", err)
+	}
+	root.Squash()
+
+	f := &memFile{}
+	size, err := Marshal(f, root, 0)
+	if err != nil {
+		t.Fatalf("failed to marshal trie: %v", err)
+	}
+
+	dt, err := Open(f, size, int32(0), 0)
+	if err != nil {
+		t.Fatalf("failed to open disk trie: %v", err)
+	}
+
+	cur, err := dt.FirstLeaf()
+	if err != nil {
+		t.Fatalf("failed to get first leaf: %v", err)
+	}
+
+	var got []int32
+	for {
+		v, err := cur.Value()
+		if err != nil {
+			t.Fatalf("failed to read value: %v", err)
+		}
+		got = append(got, v.(int32))
+
+		more, err := cur.Next()
+		if err != nil {
+			t.Fatalf("failed to advance cursor: %v", err)
+		}
+		if !more {
+			break
+		}
+	}
+
+	want := []int32{10, 20, 30}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong leaf order: got %v, want %v", got, want)
+	}
+}
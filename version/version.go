@@ -0,0 +1,11 @@
+// Package version defines the on-disk format version slim stamps into
+// every serialized header, so a reader can tell which layout produced
+// the bytes it is looking at.
+package version
+
+// VERSION is the current on-disk format version.
+const VERSION = "1.0.1"
+
+// MAXLEN is the fixed number of bytes reserved for a version string in
+// a serialized header.
+const MAXLEN = 16